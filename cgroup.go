@@ -0,0 +1,119 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// cgroupInfo is what a tc class's net_cls classid resolves to.
+type cgroupInfo struct {
+	Path        string
+	ContainerID string
+	Pod         string
+}
+
+var (
+	dockerScopeRe = regexp.MustCompile(`docker-([0-9a-f]{12,64})\.scope`)
+	podUIDRe      = regexp.MustCompile(`pod([0-9a-f]{8}(?:[_-][0-9a-f]{4}){3}[_-][0-9a-f]{12})(?:/([0-9a-f]{64}))?`)
+)
+
+// buildClassIDIndex walks the cgroup filesystem rooted at root looking for
+// net_cls.classid files (cgroup v1's net_cls controller, or a cgroup v2
+// unified hierarchy with the net_cls compat controller grafted in) and
+// returns a map from classid to the owning cgroup. The classid is the same
+// 32-bit value tc encodes as a class handle's major:minor, which is how
+// callers correlate the two.
+func buildClassIDIndex(root string) (map[uint32]cgroupInfo, error) {
+	index := map[uint32]cgroupInfo{}
+
+	netCls := filepath.Join(root, "net_cls")
+	walkRoot := root
+	if _, err := os.Stat(netCls); err == nil {
+		walkRoot = netCls
+	}
+
+	err := filepath.Walk(walkRoot, func(path string, fi os.FileInfo, err error) error {
+		if err != nil || fi.IsDir() || fi.Name() != "net_cls.classid" {
+			return nil
+		}
+		classid, ok := readClassID(path)
+		if !ok {
+			return nil
+		}
+		rel, err := filepath.Rel(walkRoot, filepath.Dir(path))
+		if err != nil {
+			return nil
+		}
+		index[classid] = cgroupInfoFromPath(rel)
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("walk cgroup hierarchy at %s: %w", walkRoot, err)
+	}
+	return index, nil
+}
+
+func readClassID(path string) (uint32, bool) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, false
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	if !scanner.Scan() {
+		return 0, false
+	}
+	v, err := strconv.ParseUint(strings.TrimSpace(scanner.Text()), 10, 32)
+	if err != nil || v == 0 {
+		return 0, false
+	}
+	return uint32(v), true
+}
+
+// cgroupInfoFromPath extracts the container ID and pod UID from the usual
+// kubepods.slice/.../docker-<id>.scope or kubepods-*/pod<uid>/<id> path
+// conventions. Either or both may be empty if the path doesn't match.
+func cgroupInfoFromPath(rel string) cgroupInfo {
+	info := cgroupInfo{Path: rel}
+	if m := dockerScopeRe.FindStringSubmatch(rel); m != nil {
+		info.ContainerID = m[1]
+	}
+	if m := podUIDRe.FindStringSubmatch(rel); m != nil {
+		info.Pod = strings.ReplaceAll(m[1], "_", "-")
+		if info.ContainerID == "" && m[2] != "" {
+			info.ContainerID = m[2]
+		}
+	}
+	return info
+}
+
+// lookupCgroup resolves a tc class handle ("major:minor" hex, as produced by
+// formatHandle) back to the numeric classid and looks it up in index.
+func lookupCgroup(index map[uint32]cgroupInfo, handle string) cgroupInfo {
+	major, minor, ok := splitHandle(handle)
+	if !ok {
+		return cgroupInfo{}
+	}
+	return index[major<<16|minor]
+}
+
+func splitHandle(handle string) (major, minor uint32, ok bool) {
+	parts := strings.SplitN(handle, ":", 2)
+	if len(parts) != 2 {
+		return 0, 0, false
+	}
+	m, err := strconv.ParseUint(parts[0], 16, 16)
+	if err != nil {
+		return 0, 0, false
+	}
+	n, err := strconv.ParseUint(parts[1], 16, 16)
+	if err != nil {
+		return 0, 0, false
+	}
+	return uint32(m), uint32(n), true
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// collectMetricsClassesFixtures reads class.json from *fixturesDir instead
+// of invoking tc or netlink. A missing file means the fixture device has no
+// classes (e.g. bare fq_codel/cake qdiscs); a malformed one is a json error,
+// same as the exec backend's.
+func collectMetricsClassesFixtures(nics []string) ([]Class, error) {
+	if len(nics) == 0 {
+		return nil, nil
+	}
+	device := nics[0]
+	data, err := os.ReadFile(filepath.Join(*fixturesDir, "class.json"))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("read fixture: %w", err)
+	}
+
+	var classes []Class
+	if err := json.Unmarshal(data, &classes); err != nil {
+		return nil, fmt.Errorf("json error: %w", err)
+	}
+	for i := range classes {
+		classes[i].Device = device
+		if classes[i].Root {
+			classes[i].Parent = "root"
+		}
+	}
+	return classes, nil
+}
+
+func collectMetricsQdiscsFixtures(nics []string) ([]Qdisc, error) {
+	if len(nics) == 0 {
+		return nil, nil
+	}
+	device := nics[0]
+	data, err := os.ReadFile(filepath.Join(*fixturesDir, "qdisc.json"))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("read fixture: %w", err)
+	}
+
+	var qdiscs []Qdisc
+	if err := json.Unmarshal(data, &qdiscs); err != nil {
+		return nil, fmt.Errorf("json error: %w", err)
+	}
+	for i := range qdiscs {
+		qdiscs[i].Device = device
+		if qdiscs[i].Root {
+			qdiscs[i].Parent = "root"
+		}
+		qdiscs[i].XStats = decodeXStats(qdiscs[i].Kind, qdiscs[i].RawXStats)
+	}
+	return qdiscs, nil
+}
@@ -0,0 +1,391 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+
+	"github.com/mdlayher/netlink"
+	"golang.org/x/sys/unix"
+)
+
+// Minimal subset of the rtnetlink tc uapi (linux/rtnetlink.h, linux/pkt_sched.h,
+// linux/gen_stats.h) needed to dump classes and qdiscs. We only decode the
+// attributes the exporter actually surfaces today.
+const (
+	rtmGetQdisc  = 38
+	rtmGetTClass = 42
+)
+
+const (
+	tcaKind    = 1
+	tcaOptions = 2
+	tcaXstats  = 4
+	tcaStats2  = 7
+)
+
+const (
+	tcaStatsBasic = 1
+	tcaStatsQueue = 3
+	tcaStatsApp   = 4
+)
+
+// tcmsg mirrors struct tcmsg from linux/rtnetlink.h.
+type tcmsg struct {
+	Family  uint8
+	_       [3]byte
+	Ifindex int32
+	Handle  uint32
+	Parent  uint32
+	Info    uint32
+}
+
+// tcHtbOpt mirrors the fixed-size prefix of struct tc_htb_opt (linux/pkt_sched.h)
+// that carries the fields this exporter exposes.
+type tcHtbOpt struct {
+	RateCellLog   uint8
+	RateLinklayer uint8
+	RateOverhead  uint16
+	RateCellAlign int16
+	RateMpu       uint16
+	Rate          uint32
+	CeilCellLog   uint8
+	CeilLinklayer uint8
+	CeilOverhead  uint16
+	CeilCellAlign int16
+	CeilMpu       uint16
+	Ceil          uint32
+	Buffer        uint32
+	Cbuffer       uint32
+	Quantum       uint32
+	Level         uint32
+	Prio          uint32
+}
+
+func dumpTC(msgType uint16, ifindex int) ([]netlink.Message, error) {
+	conn, err := netlink.Dial(unix.NETLINK_ROUTE, nil)
+	if err != nil {
+		return nil, fmt.Errorf("netlink dial: %w", err)
+	}
+	defer conn.Close()
+
+	req := tcmsg{
+		Family:  unix.AF_UNSPEC,
+		Ifindex: int32(ifindex),
+	}
+	buf := make([]byte, 20)
+	buf[0] = req.Family
+	binary.LittleEndian.PutUint32(buf[4:8], uint32(req.Ifindex))
+	binary.LittleEndian.PutUint32(buf[8:12], req.Handle)
+	binary.LittleEndian.PutUint32(buf[12:16], req.Parent)
+	binary.LittleEndian.PutUint32(buf[16:20], req.Info)
+
+	msg := netlink.Message{
+		Header: netlink.Header{
+			Type:  netlink.HeaderType(msgType),
+			Flags: netlink.Request | netlink.Dump,
+		},
+		Data: buf,
+	}
+	return conn.Execute(msg)
+}
+
+// tcBasicStats mirrors struct gnet_stats_basic (TCA_STATS_BASIC).
+type tcBasicStats struct {
+	Bytes   uint64
+	Packets uint64
+}
+
+// tcQueueStats mirrors struct gnet_stats_queue (TCA_STATS_QUEUE).
+type tcQueueStats struct {
+	Qlen       uint32
+	Backlog    uint32
+	Drops      uint32
+	Requeues   uint32
+	Overlimits uint32
+}
+
+// tcHtbAppStats mirrors struct tc_htb_xstats (TCA_STATS_APP, htb only).
+type tcHtbAppStats struct {
+	Lends   uint32
+	Borrows uint32
+	Giants  uint32
+	Tokens  uint32
+	Ctokens uint32
+}
+
+func parseTCMessages(msgs []netlink.Message) (kinds map[uint32]string, handles map[uint32]uint32, parents map[uint32]uint32, options map[uint32][]netlink.Attribute, basic map[uint32]tcBasicStats, queue map[uint32]tcQueueStats, app map[uint32]tcHtbAppStats, xstats map[uint32][]byte, order []uint32, err error) {
+	kinds = map[uint32]string{}
+	handles = map[uint32]uint32{}
+	parents = map[uint32]uint32{}
+	options = map[uint32][]netlink.Attribute{}
+	basic = map[uint32]tcBasicStats{}
+	queue = map[uint32]tcQueueStats{}
+	app = map[uint32]tcHtbAppStats{}
+	xstats = map[uint32][]byte{}
+
+	for i, m := range msgs {
+		if len(m.Data) < 20 {
+			continue
+		}
+		handle := binary.LittleEndian.Uint32(m.Data[8:12])
+		parent := binary.LittleEndian.Uint32(m.Data[12:16])
+		// Use the message index as a stable per-scrape key; handle 0 (root)
+		// would otherwise collide across qdiscs.
+		key := uint32(i)
+		handles[key] = handle
+		parents[key] = parent
+		order = append(order, key)
+
+		attrs, aerr := netlink.UnmarshalAttributes(m.Data[20:])
+		if aerr != nil {
+			err = fmt.Errorf("attribute parse: %w", aerr)
+			return
+		}
+		for _, a := range attrs {
+			switch a.Type {
+			case tcaKind:
+				kinds[key] = nullTerminated(a.Data)
+			case tcaOptions:
+				nested, nerr := netlink.UnmarshalAttributes(a.Data)
+				if nerr == nil {
+					options[key] = nested
+				}
+			case tcaXstats:
+				xstats[key] = a.Data
+			case tcaStats2:
+				nested, nerr := netlink.UnmarshalAttributes(a.Data)
+				if nerr != nil {
+					continue
+				}
+				for _, n := range nested {
+					switch n.Type {
+					case tcaStatsBasic:
+						if len(n.Data) >= 12 {
+							basic[key] = tcBasicStats{
+								Bytes:   binary.LittleEndian.Uint64(n.Data[0:8]),
+								Packets: uint64(binary.LittleEndian.Uint32(n.Data[8:12])),
+							}
+						}
+					case tcaStatsQueue:
+						if len(n.Data) >= 20 {
+							queue[key] = tcQueueStats{
+								Qlen:       binary.LittleEndian.Uint32(n.Data[0:4]),
+								Backlog:    binary.LittleEndian.Uint32(n.Data[4:8]),
+								Drops:      binary.LittleEndian.Uint32(n.Data[8:12]),
+								Requeues:   binary.LittleEndian.Uint32(n.Data[12:16]),
+								Overlimits: binary.LittleEndian.Uint32(n.Data[16:20]),
+							}
+						}
+					case tcaStatsApp:
+						// only htb classes populate TCA_STATS_APP today.
+						if len(n.Data) >= 20 {
+							app[key] = tcHtbAppStats{
+								Lends:   binary.LittleEndian.Uint32(n.Data[0:4]),
+								Borrows: binary.LittleEndian.Uint32(n.Data[4:8]),
+								Giants:  binary.LittleEndian.Uint32(n.Data[8:12]),
+								Tokens:  binary.LittleEndian.Uint32(n.Data[12:16]),
+								Ctokens: binary.LittleEndian.Uint32(n.Data[16:20]),
+							}
+						}
+					}
+				}
+			}
+		}
+	}
+	return
+}
+
+func nullTerminated(b []byte) string {
+	for i, c := range b {
+		if c == 0 {
+			return string(b[:i])
+		}
+	}
+	return string(b)
+}
+
+func ifindexByName(nic string) (int, error) {
+	iface, err := net.InterfaceByName(nic)
+	if err != nil {
+		return 0, err
+	}
+	return iface.Index, nil
+}
+
+// formatHandle renders a tc handle the way `tc -name` does: "major:minor" in hex.
+func formatHandle(h uint32) string {
+	if h == 0 {
+		return ""
+	}
+	if h&0xffff == 0 {
+		return fmt.Sprintf("%x:", h>>16)
+	}
+	return fmt.Sprintf("%x:%x", h>>16, h&0xffff)
+}
+
+func htbOptFromAttrs(attrs []netlink.Attribute) (rate, ceil, buffer, cbuffer uint64, ok bool) {
+	const tcaHtbParms = 1
+	for _, a := range attrs {
+		if a.Type != tcaHtbParms || len(a.Data) < 44 {
+			continue
+		}
+		rate = uint64(binary.LittleEndian.Uint32(a.Data[8:12]))
+		ceil = uint64(binary.LittleEndian.Uint32(a.Data[20:24]))
+		buffer = uint64(binary.LittleEndian.Uint32(a.Data[24:28]))
+		cbuffer = uint64(binary.LittleEndian.Uint32(a.Data[28:32]))
+		ok = true
+	}
+	return
+}
+
+func collectClassesNetlink(nics []string) ([]Class, error) {
+	var classes []Class
+	for _, nic := range nics {
+		idx, err := ifindexByName(nic)
+		if err != nil {
+			continue
+		}
+		msgs, err := dumpTC(rtmGetTClass, idx)
+		if err != nil {
+			return nil, fmt.Errorf("netlink dump classes on %s: %w", nic, err)
+		}
+		kinds, handles, parents, options, basic, queue, app, _, order, err := parseTCMessages(msgs)
+		if err != nil {
+			return nil, fmt.Errorf("parse classes on %s: %w", nic, err)
+		}
+		for _, key := range order {
+			rate, ceil, buffer, cbuffer, _ := htbOptFromAttrs(options[key])
+			c := Class{
+				Device: nic,
+				Kind:   kinds[key],
+				Handle: formatHandle(handles[key]),
+				Parent: formatHandle(parents[key]),
+				Rate:   rate,
+				Ceil:   ceil,
+				Burst:  buffer,
+				Cburst: cbuffer,
+				Stats: Stats{
+					Bytes:      basic[key].Bytes,
+					Packets:    basic[key].Packets,
+					Qlen:       uint64(queue[key].Qlen),
+					Backlog:    uint64(queue[key].Backlog),
+					Drops:      uint64(queue[key].Drops),
+					Overlimits: uint64(queue[key].Overlimits),
+					Requeues:   uint64(queue[key].Requeues),
+					Lended:     uint64(app[key].Lends),
+					Borrowed:   uint64(app[key].Borrows),
+					Giants:     uint64(app[key].Giants),
+					Tokens:     int64(int32(app[key].Tokens)),
+					Ctokens:    int64(int32(app[key].Ctokens)),
+				},
+			}
+			if c.Parent == "" {
+				c.Root = true
+				c.Parent = "root"
+			}
+			classes = append(classes, c)
+		}
+	}
+	return classes, nil
+}
+
+func collectQdiscsNetlink(nics []string) ([]Qdisc, error) {
+	var qdiscs []Qdisc
+	for _, nic := range nics {
+		idx, err := ifindexByName(nic)
+		if err != nil {
+			continue
+		}
+		msgs, err := dumpTC(rtmGetQdisc, idx)
+		if err != nil {
+			return nil, fmt.Errorf("netlink dump qdiscs on %s: %w", nic, err)
+		}
+		kinds, handles, parents, _, basic, queue, _, xstats, order, err := parseTCMessages(msgs)
+		if err != nil {
+			return nil, fmt.Errorf("parse qdiscs on %s: %w", nic, err)
+		}
+		for _, key := range order {
+			q := Qdisc{
+				Device:     nic,
+				Kind:       kinds[key],
+				Handle:     formatHandle(handles[key]),
+				Parent:     formatHandle(parents[key]),
+				Bytes:      basic[key].Bytes,
+				Packets:    basic[key].Packets,
+				Qlen:       uint64(queue[key].Qlen),
+				Backlog:    uint64(queue[key].Backlog),
+				Drops:      uint64(queue[key].Drops),
+				Requeues:   uint64(queue[key].Requeues),
+				Overlimits: uint64(queue[key].Overlimits),
+				XStats:     decodeXStatsNetlink(kinds[key], xstats[key]),
+			}
+			if q.Parent == "" {
+				q.Root = true
+				q.Parent = "root"
+			}
+			qdiscs = append(qdiscs, q)
+		}
+	}
+	return qdiscs, nil
+}
+
+// decodeXStatsNetlink decodes the raw TCA_XSTATS payload for the kinds whose
+// xstats are a fixed-layout kernel struct (linux/pkt_sched.h). cake's xstats
+// is a nested-attribute tree rather than a flat struct and isn't decoded
+// here; use --exec-fallback (which reads tc's own JSON) for cake tin detail.
+func decodeXStatsNetlink(kind string, data []byte) XStats {
+	var xs XStats
+	switch kind {
+	case "fq_codel":
+		// struct tc_fq_codel_xstats leads with a __u32 type discriminator
+		// before the tc_fq_codel_qd_stats payload this exporter reads.
+		if len(data) >= 36 {
+			xs.FqCodel = &FqCodelXStats{
+				MaxPacket:     uint64(binary.LittleEndian.Uint32(data[4:8])),
+				DropOverlimit: uint64(binary.LittleEndian.Uint32(data[8:12])),
+				EcnMark:       uint64(binary.LittleEndian.Uint32(data[12:16])),
+				NewFlowCount:  uint64(binary.LittleEndian.Uint32(data[16:20])),
+				NewFlowsLen:   uint64(binary.LittleEndian.Uint32(data[20:24])),
+				OldFlowsLen:   uint64(binary.LittleEndian.Uint32(data[24:28])),
+				MemoryUsed:    uint64(binary.LittleEndian.Uint32(data[32:36])),
+			}
+		}
+	case "sfq":
+		if len(data) >= 4 {
+			xs.Sfq = &SfqXStats{Allot: int64(int32(binary.LittleEndian.Uint32(data[0:4])))}
+		}
+	case "red":
+		if len(data) >= 16 {
+			xs.Red = &RedXStats{
+				Early:  uint64(binary.LittleEndian.Uint32(data[0:4])),
+				Pdrop:  uint64(binary.LittleEndian.Uint32(data[4:8])),
+				Other:  uint64(binary.LittleEndian.Uint32(data[8:12])),
+				Marked: uint64(binary.LittleEndian.Uint32(data[12:16])),
+			}
+		}
+	case "pie":
+		// struct tc_pie_xstats leads with a __u64 prob, not a __u32, so every
+		// later field sits 8 bytes in rather than 4.
+		if len(data) >= 40 {
+			xs.Pie = &PieXStats{
+				Prob:      binary.LittleEndian.Uint64(data[0:8]),
+				Delay:     uint64(binary.LittleEndian.Uint32(data[8:12])),
+				AvgDqRate: uint64(binary.LittleEndian.Uint32(data[12:16])),
+				PacketsIn: uint64(binary.LittleEndian.Uint32(data[16:20])),
+				Dropped:   uint64(binary.LittleEndian.Uint32(data[20:24])),
+				Overlimit: uint64(binary.LittleEndian.Uint32(data[24:28])),
+				Maxq:      uint64(binary.LittleEndian.Uint32(data[28:32])),
+				EcnMark:   uint64(binary.LittleEndian.Uint32(data[32:36])),
+			}
+		}
+	case "tbf":
+		if len(data) >= 16 {
+			xs.Tbf = &TbfXStats{
+				Tokens:  int64(int32(binary.LittleEndian.Uint32(data[0:4]))),
+				Ptokens: int64(int32(binary.LittleEndian.Uint32(data[4:8]))),
+			}
+		}
+	}
+	return xs
+}
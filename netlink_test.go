@@ -0,0 +1,205 @@
+package main
+
+import (
+	"encoding/binary"
+	"testing"
+
+	"github.com/mdlayher/netlink"
+)
+
+// htbOpt builds the 44-byte TCA_HTB_PARMS payload (struct tc_htb_opt) with
+// distinct rate/ceil/buffer/cbuffer/quantum values so a field mixup between
+// offsets shows up as a test failure rather than a coincidental match.
+func htbOpt(rate, ceil, buffer, cbuffer, quantum uint32) []byte {
+	b := make([]byte, 44)
+	binary.LittleEndian.PutUint32(b[8:12], rate)  // rate.rate
+	binary.LittleEndian.PutUint32(b[20:24], ceil) // ceil.rate
+	binary.LittleEndian.PutUint32(b[24:28], buffer)
+	binary.LittleEndian.PutUint32(b[28:32], cbuffer)
+	binary.LittleEndian.PutUint32(b[32:36], quantum)
+	return b
+}
+
+// TestHtbOptFromAttrs decodes a captured-shape TCA_HTB_PARMS blob and checks
+// each field lands on its own offset rather than a neighbour's.
+func TestHtbOptFromAttrs(t *testing.T) {
+	const tcaHtbParms = 1
+	raw, err := netlink.MarshalAttributes([]netlink.Attribute{
+		{Type: tcaHtbParms, Data: htbOpt(125000, 250000, 1600, 3200, 1500)},
+	})
+	if err != nil {
+		t.Fatalf("marshal attributes: %v", err)
+	}
+	attrs, err := netlink.UnmarshalAttributes(raw)
+	if err != nil {
+		t.Fatalf("unmarshal attributes: %v", err)
+	}
+
+	rate, ceil, buffer, cbuffer, ok := htbOptFromAttrs(attrs)
+	if !ok {
+		t.Fatal("htbOptFromAttrs: ok = false")
+	}
+	if rate != 125000 || ceil != 250000 || buffer != 1600 || cbuffer != 3200 {
+		t.Errorf("htbOptFromAttrs = rate=%d ceil=%d buffer=%d cbuffer=%d, want rate=125000 ceil=250000 buffer=1600 cbuffer=3200", rate, ceil, buffer, cbuffer)
+	}
+}
+
+// TestParseTCMessagesHTBClass feeds a synthetic RTM_NEWTCLASS-shaped message
+// through parseTCMessages, exercising the netlink decode path end to end
+// without a live rtnetlink socket.
+func TestParseTCMessagesHTBClass(t *testing.T) {
+	const (
+		tcaHtbParms   = 1
+		tcaKindT      = 1
+		tcaOptionsT   = 2
+		tcaStats2T    = 7
+		tcaStatsBasic = 1
+		tcaStatsQueue = 3
+		tcaStatsApp   = 4
+	)
+
+	opts, err := netlink.MarshalAttributes([]netlink.Attribute{
+		{Type: tcaHtbParms, Data: htbOpt(125000, 250000, 1600, 3200, 1500)},
+	})
+	if err != nil {
+		t.Fatalf("marshal options: %v", err)
+	}
+
+	basic := make([]byte, 12)
+	binary.LittleEndian.PutUint64(basic[0:8], 51200)
+	binary.LittleEndian.PutUint32(basic[8:12], 400)
+
+	queue := make([]byte, 20)
+	binary.LittleEndian.PutUint32(queue[0:4], 0)   // qlen
+	binary.LittleEndian.PutUint32(queue[4:8], 0)   // backlog
+	binary.LittleEndian.PutUint32(queue[8:12], 2)  // drops
+	binary.LittleEndian.PutUint32(queue[12:16], 1) // requeues
+	binary.LittleEndian.PutUint32(queue[16:20], 5) // overlimits
+
+	app := make([]byte, 20)
+	binary.LittleEndian.PutUint32(app[0:4], 300) // lends
+	binary.LittleEndian.PutUint32(app[4:8], 50)  // borrows
+
+	stats2, err := netlink.MarshalAttributes([]netlink.Attribute{
+		{Type: tcaStatsBasic, Data: basic},
+		{Type: tcaStatsQueue, Data: queue},
+		{Type: tcaStatsApp, Data: app},
+	})
+	if err != nil {
+		t.Fatalf("marshal stats2: %v", err)
+	}
+
+	attrs, err := netlink.MarshalAttributes([]netlink.Attribute{
+		{Type: tcaKindT, Data: append([]byte("htb"), 0)},
+		{Type: tcaOptionsT, Data: opts},
+		{Type: tcaStats2T, Data: stats2},
+	})
+	if err != nil {
+		t.Fatalf("marshal message attrs: %v", err)
+	}
+
+	data := make([]byte, 20+len(attrs))
+	binary.LittleEndian.PutUint32(data[8:12], 0x10010)  // handle 1:10
+	binary.LittleEndian.PutUint32(data[12:16], 0x10001) // parent 1:1
+	copy(data[20:], attrs)
+
+	kinds, handles, parents, options, basicOut, queueOut, appOut, _, order, err := parseTCMessages([]netlink.Message{{Data: data}})
+	if err != nil {
+		t.Fatalf("parseTCMessages: %v", err)
+	}
+	if len(order) != 1 {
+		t.Fatalf("len(order) = %d, want 1", len(order))
+	}
+	key := order[0]
+
+	if kinds[key] != "htb" {
+		t.Errorf("kind = %q, want htb", kinds[key])
+	}
+	if got := formatHandle(handles[key]); got != "1:10" {
+		t.Errorf("handle = %q, want 1:10", got)
+	}
+	if got := formatHandle(parents[key]); got != "1:1" {
+		t.Errorf("parent = %q, want 1:1", got)
+	}
+
+	rate, ceil, buffer, cbuffer, ok := htbOptFromAttrs(options[key])
+	if !ok || rate != 125000 || ceil != 250000 || buffer != 1600 || cbuffer != 3200 {
+		t.Errorf("htb options = rate=%d ceil=%d buffer=%d cbuffer=%d ok=%v, want rate=125000 ceil=250000 buffer=1600 cbuffer=3200 ok=true", rate, ceil, buffer, cbuffer, ok)
+	}
+
+	if basicOut[key].Bytes != 51200 || basicOut[key].Packets != 400 {
+		t.Errorf("basic stats = %+v, want bytes=51200 packets=400", basicOut[key])
+	}
+	if queueOut[key].Drops != 2 || queueOut[key].Requeues != 1 || queueOut[key].Overlimits != 5 {
+		t.Errorf("queue stats = %+v, want drops=2 requeues=1 overlimits=5", queueOut[key])
+	}
+	if appOut[key].Lends != 300 || appOut[key].Borrows != 50 {
+		t.Errorf("app stats = %+v, want lends=300 borrows=50", appOut[key])
+	}
+}
+
+// TestDecodeXStatsNetlinkFqCodel decodes a struct tc_fq_codel_xstats blob
+// (the leading __u32 type discriminator, then the qdisc_stats payload).
+func TestDecodeXStatsNetlinkFqCodel(t *testing.T) {
+	data := make([]byte, 36)
+	binary.LittleEndian.PutUint32(data[0:4], 0)       // type (qdisc stats)
+	binary.LittleEndian.PutUint32(data[4:8], 1514)    // maxpacket
+	binary.LittleEndian.PutUint32(data[8:12], 7)      // drop_overlimit
+	binary.LittleEndian.PutUint32(data[12:16], 40)    // ecn_mark
+	binary.LittleEndian.PutUint32(data[16:20], 900)   // new_flow_count
+	binary.LittleEndian.PutUint32(data[20:24], 1)     // new_flows_len
+	binary.LittleEndian.PutUint32(data[24:28], 3)     // old_flows_len
+	binary.LittleEndian.PutUint32(data[28:32], 0)     // ce_mark (unused)
+	binary.LittleEndian.PutUint32(data[32:36], 16384) // memory_usage
+
+	xs := decodeXStatsNetlink("fq_codel", data)
+	if xs.FqCodel == nil {
+		t.Fatal("FqCodel = nil")
+	}
+	got := *xs.FqCodel
+	want := FqCodelXStats{
+		MaxPacket:     1514,
+		DropOverlimit: 7,
+		EcnMark:       40,
+		NewFlowCount:  900,
+		NewFlowsLen:   1,
+		OldFlowsLen:   3,
+		MemoryUsed:    16384,
+	}
+	if got != want {
+		t.Errorf("decodeXStatsNetlink(fq_codel) = %+v, want %+v", got, want)
+	}
+}
+
+// TestDecodeXStatsNetlinkPie decodes a struct tc_pie_xstats blob, whose
+// leading __u64 prob field shifts every later offset by 8 bytes rather than 4.
+func TestDecodeXStatsNetlinkPie(t *testing.T) {
+	data := make([]byte, 40)
+	binary.LittleEndian.PutUint64(data[0:8], 12)
+	binary.LittleEndian.PutUint32(data[8:12], 7)
+	binary.LittleEndian.PutUint32(data[12:16], 625000)
+	binary.LittleEndian.PutUint32(data[16:20], 40000)
+	binary.LittleEndian.PutUint32(data[20:24], 60)
+	binary.LittleEndian.PutUint32(data[24:28], 0)
+	binary.LittleEndian.PutUint32(data[28:32], 64)
+	binary.LittleEndian.PutUint32(data[32:36], 15)
+
+	xs := decodeXStatsNetlink("pie", data)
+	if xs.Pie == nil {
+		t.Fatal("Pie = nil")
+	}
+	got := *xs.Pie
+	want := PieXStats{
+		Prob:      12,
+		Delay:     7,
+		AvgDqRate: 625000,
+		PacketsIn: 40000,
+		Dropped:   60,
+		Overlimit: 0,
+		Maxq:      64,
+		EcnMark:   15,
+	}
+	if got != want {
+		t.Errorf("decodeXStatsNetlink(pie) = %+v, want %+v", got, want)
+	}
+}
@@ -7,8 +7,9 @@ import (
 	"log"
 	"net"
 	"net/http"
-	"os"
 	"os/exec"
+	"path/filepath"
+	"regexp"
 
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
@@ -51,123 +52,507 @@ type Options struct {
 }
 
 type Qdisc struct {
-	Device     string  `json:"device"`
-	Parent     string  `json:"parent"`
-	Kind       string  `json:"class"`
-	Handle     string  `json:"handle"`
-	Root       bool    `json:"root"`
-	Options    Options `json:"options"`
-	Bytes      uint64  `json:"bytes"`
-	Packets    uint64  `json:"packets"`
-	Drops      uint64  `json:"drops"`
-	Overlimits uint64  `json:"overlimits"`
-	Requeues   uint64  `json:"requeues"`
-	Backlog    uint64  `json:"backlog"`
-	Qlen       uint64  `json:"qlen"`
+	Device     string          `json:"device"`
+	Parent     string          `json:"parent"`
+	Kind       string          `json:"class"`
+	Handle     string          `json:"handle"`
+	Root       bool            `json:"root"`
+	Options    Options         `json:"options"`
+	Bytes      uint64          `json:"bytes"`
+	Packets    uint64          `json:"packets"`
+	Drops      uint64          `json:"drops"`
+	Overlimits uint64          `json:"overlimits"`
+	Requeues   uint64          `json:"requeues"`
+	Backlog    uint64          `json:"backlog"`
+	Qlen       uint64          `json:"qlen"`
+	RawXStats  json.RawMessage `json:"xstats"`
+	XStats     XStats          `json:"-"`
 }
 
-// Split metric registry for params and stats
+// XStats holds the decoded per-kind extended statistics (TCA_XSTATS). At most
+// one field is populated, matching Qdisc.Kind; kinds without decoded xstats
+// (htb included) leave every field nil.
+type XStats struct {
+	FqCodel *FqCodelXStats
+	Cake    *CakeXStats
+	Tbf     *TbfXStats
+	Sfq     *SfqXStats
+	Red     *RedXStats
+	Pie     *PieXStats
+}
+
+type FqCodelXStats struct {
+	MaxPacket     uint64 `json:"maxpacket"`
+	DropOverlimit uint64 `json:"drop_overlimit"`
+	EcnMark       uint64 `json:"ecn_mark"`
+	NewFlowCount  uint64 `json:"new_flow_count"`
+	NewFlowsLen   uint64 `json:"new_flows_len"`
+	OldFlowsLen   uint64 `json:"old_flows_len"`
+	MemoryUsed    uint64 `json:"memory_used"`
+}
+
+type CakeTinStats struct {
+	SentBytes         uint64 `json:"sent_bytes"`
+	SentPackets       uint64 `json:"sent_packets"`
+	Drops             uint64 `json:"drops"`
+	EcnMarks          uint64 `json:"ecn_marks"`
+	SparseFlows       uint64 `json:"sparse_flows"`
+	BulkFlows         uint64 `json:"bulk_flows"`
+	UnresponsiveFlows uint64 `json:"unresponsive_flows"`
+}
+
+type CakeXStats struct {
+	Tins []CakeTinStats `json:"tins"`
+}
+
+type TbfXStats struct {
+	Tokens  int64 `json:"tokens"`
+	Ptokens int64 `json:"ptokens"`
+}
+
+type SfqXStats struct {
+	Allot int64 `json:"allot"`
+}
+
+type RedXStats struct {
+	Early  uint64 `json:"early"`
+	Pdrop  uint64 `json:"pdrop"`
+	Other  uint64 `json:"other"`
+	Marked uint64 `json:"marked"`
+}
+
+type PieXStats struct {
+	Prob      uint64 `json:"prob"`
+	Delay     uint64 `json:"delay"`
+	AvgDqRate uint64 `json:"avg_dq_rate"`
+	PacketsIn uint64 `json:"packets_in"`
+	Dropped   uint64 `json:"dropped"`
+	Overlimit uint64 `json:"overlimit"`
+	Maxq      uint64 `json:"maxq"`
+	EcnMark   uint64 `json:"ecn_mark"`
+}
+
+// decodeXStats parses the kind-specific xstats object that `tc -s -j`
+// already emits (json.RawMessage from the "xstats" field). Unknown kinds
+// (including plain htb) are left as a zero XStats.
+func decodeXStats(kind string, raw json.RawMessage) XStats {
+	var xs XStats
+	if len(raw) == 0 {
+		return xs
+	}
+	switch kind {
+	case "fq_codel":
+		var v FqCodelXStats
+		if json.Unmarshal(raw, &v) == nil {
+			xs.FqCodel = &v
+		}
+	case "cake":
+		var v CakeXStats
+		if json.Unmarshal(raw, &v) == nil {
+			xs.Cake = &v
+		}
+	case "tbf":
+		var v TbfXStats
+		if json.Unmarshal(raw, &v) == nil {
+			xs.Tbf = &v
+		}
+	case "sfq":
+		var v SfqXStats
+		if json.Unmarshal(raw, &v) == nil {
+			xs.Sfq = &v
+		}
+	case "red":
+		var v RedXStats
+		if json.Unmarshal(raw, &v) == nil {
+			xs.Red = &v
+		}
+	case "pie":
+		var v PieXStats
+		if json.Unmarshal(raw, &v) == nil {
+			xs.Pie = &v
+		}
+	}
+	return xs
+}
+
+var labelNames = []string{"kind", "handle", "parent", "device"}
+
+// desc builds a *prometheus.Desc over the common kind/handle/parent/device
+// label set; the value type (counter vs. gauge) is chosen at Collect time.
+func desc(name, help string) *prometheus.Desc {
+	return prometheus.NewDesc(name, help, labelNames, nil)
+}
+
+// Qdisc descriptors. Monotonically increasing kernel counters are exposed
+// as counters (suffixed _total); everything else (instantaneous queue
+// state, the configured shaping parameters) is a gauge. Class descriptors
+// live on tcCollector instead of here, because --collector.cgroup-correlation
+// changes their label set.
 var (
-	statsRegistry  = prometheus.NewRegistry()
-	paramsRegistry = prometheus.NewRegistry()
-
-	// Params (static/low-frequency)
-	// Class
-	prioGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
-		Name: "tc_class_prio",
-		Help: "class priority of leaf; lower are served first",
-	}, []string{"kind", "handle", "parent", "device"})
-	rateGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
-		Name: "tc_class_rate",
-		Help: "rate allocated to this class (htb class can still borrow)",
-	}, []string{"kind", "handle", "parent", "device"})
-	ceilGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
-		Name: "tc_class_ceil",
-		Help: "rate at which the class can send if its parent has bandwidth to spare (htb)",
-	}, []string{"kind", "handle", "parent", "device"})
-	burstGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
-		Name: "tc_class_burst",
-		Help: "bytes that can be burst at ceil speed {computed}",
-	}, []string{"kind", "handle", "parent", "device"})
-	cburstGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
-		Name: "tc_class_cburst",
-		Help: "bytes that can be burst at 'infinite' speed {computed}",
-	}, []string{"kind", "handle", "parent", "device"})
-	// qdisc
-	r2qGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
-		Name: "tc_qdisc_options_r2q",
-		Help: "Divisor used to calculate quantum values for classes.  Classes divide rate by this number.",
-	}, []string{"kind", "handle", "parent", "device"})
-	direct_packets_statGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
-		Name: "tc_qdisc_options_direct_packets_stat",
-		Help: "direct_packets_stat option",
-	}, []string{"kind", "handle", "parent", "device"})
-	direct_qlenGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
-		Name: "tc_qdisc_options_direct_qlen",
-		Help: "direct_qlen option",
-	}, []string{"kind", "handle", "parent", "device"})
-
-	// Stats (dynamic/high-frequency)
-	cstatsBytesGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
-		Name: "tc_class_stats_bytes",
-		Help: "number of seen bytes",
-	}, []string{"kind", "handle", "parent", "device"})
-	cstatsPacketsGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
-		Name: "tc_class_stats_packets",
-		Help: "number of seen packets",
-	}, []string{"kind", "handle", "parent", "device"})
-	cstatsDropsGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
-		Name: "tc_class_stats_drops",
-		Help: "number of dropped packets",
-	}, []string{"kind", "handle", "parent", "device"})
-	cstatsOverlimitsGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
-		Name: "tc_class_stats_overlimits",
-		Help: "number of enqueues over the limit",
-	}, []string{"kind", "handle", "parent", "device"})
-	cstatsRequeuesGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
-		Name: "tc_class_stats_requeues",
-		Help: "number of requeues",
-	}, []string{"kind", "handle", "parent", "device"})
-	cstatsLendedGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
-		Name: "tc_class_stats_lended",
-		Help: "lended tokens (htb)",
-	}, []string{"kind", "handle", "parent", "device"})
-	cstatsBorrowedGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
-		Name: "tc_class_stats_borrowed",
-		Help: "borrowed tokens (htb)",
-	}, []string{"kind", "handle", "parent", "device"})
-
-	qstatsBytesGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
-		Name: "tc_qdisc_bytes",
-		Help: "number of seen bytes",
-	}, []string{"kind", "handle", "parent", "device"})
-	qstatsPacketsGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
-		Name: "tc_qdisc_packets",
-		Help: "number of seen packets",
-	}, []string{"kind", "handle", "parent", "device"})
-	qstatsDropsGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
-		Name: "tc_qdisc_drops",
-		Help: "number of dropped packets",
-	}, []string{"kind", "handle", "parent", "device"})
-	qstatsOverlimitsGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
-		Name: "tc_qdisc_overlimits",
-		Help: "number of enqueues over the limit",
-	}, []string{"kind", "handle", "parent", "device"})
-	qstatsRequeuesGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
-		Name: "tc_qdisc_requeues",
-		Help: "number of requeues",
-	}, []string{"kind", "handle", "parent", "device"})
-	qstatsBacklogGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
-		Name: "tc_qdisc_backlog",
-		Help: "backlog size",
-	}, []string{"kind", "handle", "parent", "device"})
-	qstatsLenGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
-		Name: "tc_qdisc_qlen",
-		Help: "qlen size",
-	}, []string{"kind", "handle", "parent", "device"})
+	qdiscR2qDesc               = desc("tc_qdisc_options_r2q", "Divisor used to calculate quantum values for classes.  Classes divide rate by this number.")
+	qdiscDirectPacketsStatDesc = desc("tc_qdisc_options_direct_packets_stat", "direct_packets_stat option")
+	qdiscDirectQlenDesc        = desc("tc_qdisc_options_direct_qlen", "direct_qlen option")
+
+	qdiscBytesDesc      = desc("tc_qdisc_bytes_total", "number of seen bytes")
+	qdiscPacketsDesc    = desc("tc_qdisc_packets_total", "number of seen packets")
+	qdiscDropsDesc      = desc("tc_qdisc_drops_total", "number of dropped packets")
+	qdiscOverlimitsDesc = desc("tc_qdisc_overlimits_total", "number of enqueues over the limit")
+	qdiscRequeuesDesc   = desc("tc_qdisc_requeues_total", "number of requeues")
+	qdiscBacklogDesc    = desc("tc_qdisc_backlog", "backlog size")
+	qdiscQlenDesc       = desc("tc_qdisc_qlen", "qlen size")
+
+	// Per-kind extended statistics (TCA_XSTATS), populated only for qdiscs
+	// of the matching kind.
+	fqCodelMaxPacketDesc     = desc("tc_qdisc_fq_codel_maxpacket", "largest packet seen so far (fq_codel)")
+	fqCodelDropOverlimitDesc = desc("tc_qdisc_fq_codel_drop_overlimit_total", "drops due to queue limit (fq_codel)")
+	fqCodelEcnMarkDesc       = desc("tc_qdisc_fq_codel_ecn_mark_total", "ECN marks (fq_codel)")
+	fqCodelNewFlowCountDesc  = desc("tc_qdisc_fq_codel_new_flow_count_total", "flows moved from new to old (fq_codel)")
+	fqCodelNewFlowsLenDesc   = desc("tc_qdisc_fq_codel_new_flows_len", "number of new flows (fq_codel)")
+	fqCodelOldFlowsLenDesc   = desc("tc_qdisc_fq_codel_old_flows_len", "number of old flows (fq_codel)")
+	fqCodelMemoryUsedDesc    = desc("tc_qdisc_fq_codel_memory_used", "memory used by queued packets (fq_codel)")
+
+	cakeTinSentBytesDesc         = prometheus.NewDesc("tc_qdisc_cake_tin_sent_bytes_total", "bytes sent from this tin (cake)", append(labelNames, "tin"), nil)
+	cakeTinSentPacketsDesc       = prometheus.NewDesc("tc_qdisc_cake_tin_sent_packets_total", "packets sent from this tin (cake)", append(labelNames, "tin"), nil)
+	cakeTinDropsDesc             = prometheus.NewDesc("tc_qdisc_cake_tin_drops_total", "drops in this tin (cake)", append(labelNames, "tin"), nil)
+	cakeTinEcnMarksDesc          = prometheus.NewDesc("tc_qdisc_cake_tin_ecn_marks_total", "ECN marks in this tin (cake)", append(labelNames, "tin"), nil)
+	cakeTinSparseFlowsDesc       = prometheus.NewDesc("tc_qdisc_cake_tin_sparse_flows", "sparse flows in this tin (cake)", append(labelNames, "tin"), nil)
+	cakeTinBulkFlowsDesc         = prometheus.NewDesc("tc_qdisc_cake_tin_bulk_flows", "bulk flows in this tin (cake)", append(labelNames, "tin"), nil)
+	cakeTinUnresponsiveFlowsDesc = prometheus.NewDesc("tc_qdisc_cake_tin_unresponsive_flows", "unresponsive flows in this tin (cake)", append(labelNames, "tin"), nil)
+
+	tbfTokensDesc  = desc("tc_qdisc_tbf_tokens", "current token bucket level (tbf)")
+	tbfPtokensDesc = desc("tc_qdisc_tbf_ptokens", "current peak-rate token bucket level (tbf)")
+
+	sfqAllotDesc = desc("tc_qdisc_sfq_allot", "current allotment for the active flow (sfq)")
+
+	redEarlyDesc  = desc("tc_qdisc_red_early_total", "early (probabilistic) drops (red)")
+	redPdropDesc  = desc("tc_qdisc_red_pdrop_total", "drops forced by queue overflow (red)")
+	redOtherDesc  = desc("tc_qdisc_red_other_total", "drops caused by other reasons (red)")
+	redMarkedDesc = desc("tc_qdisc_red_marked_total", "ECN marks (red)")
+
+	pieProbDesc      = desc("tc_qdisc_pie_prob", "current drop/mark probability (pie)")
+	pieDelayDesc     = desc("tc_qdisc_pie_delay", "current estimated queueing delay in ms (pie)")
+	pieAvgDqRateDesc = desc("tc_qdisc_pie_avg_dq_rate", "current average dequeue rate (pie)")
+	piePacketsInDesc = desc("tc_qdisc_pie_packets_in_total", "packets enqueued (pie)")
+	pieDroppedDesc   = desc("tc_qdisc_pie_dropped_total", "packets dropped due to pie's drop/mark action (pie)")
+	pieOverlimitDesc = desc("tc_qdisc_pie_overlimit_total", "packets dropped due to lack of queue space (pie)")
+	pieMaxqDesc      = desc("tc_qdisc_pie_maxq", "maximum queue size seen so far (pie)")
+	pieEcnMarkDesc   = desc("tc_qdisc_pie_ecn_mark_total", "ECN marks (pie)")
 )
 
+// tcCollector implements prometheus.Collector, reading fresh class and qdisc
+// data (one dump of each per device) on every Collect call and yielding const
+// metrics. This replaces the old
+// GaugeVec-plus-Reset() approach, which raced under concurrent scrapes and
+// made rate() on the cumulative counters undefined whenever a class
+// disappeared and reappeared between scrapes.
+//
+// The class descriptors carry cgroup/container_id/pod labels in addition to
+// the usual kind/handle/parent/device set when --collector.cgroup-correlation
+// is on, so they're built per-instance rather than at package init.
+type tcCollector struct {
+	cgroupCorrelation bool
+
+	classPrioDesc   *prometheus.Desc
+	classRateDesc   *prometheus.Desc
+	classCeilDesc   *prometheus.Desc
+	classBurstDesc  *prometheus.Desc
+	classCburstDesc *prometheus.Desc
+
+	classBytesDesc      *prometheus.Desc
+	classPacketsDesc    *prometheus.Desc
+	classDropsDesc      *prometheus.Desc
+	classOverlimitsDesc *prometheus.Desc
+	classRequeuesDesc   *prometheus.Desc
+	classLendedDesc     *prometheus.Desc
+	classBorrowedDesc   *prometheus.Desc
+	classBacklogDesc    *prometheus.Desc
+	classQlenDesc       *prometheus.Desc
+}
+
+func newTCCollector() *tcCollector {
+	names := labelNames
+	if *cgroupCorrelation {
+		names = append(append([]string{}, labelNames...), "cgroup", "container_id", "pod")
+	}
+	classDesc := func(name, help string) *prometheus.Desc {
+		return prometheus.NewDesc(name, help, names, nil)
+	}
+	return &tcCollector{
+		cgroupCorrelation: *cgroupCorrelation,
+
+		classPrioDesc:   classDesc("tc_class_prio", "class priority of leaf; lower are served first"),
+		classRateDesc:   classDesc("tc_class_rate", "rate allocated to this class (htb class can still borrow)"),
+		classCeilDesc:   classDesc("tc_class_ceil", "rate at which the class can send if its parent has bandwidth to spare (htb)"),
+		classBurstDesc:  classDesc("tc_class_burst", "bytes that can be burst at ceil speed {computed}"),
+		classCburstDesc: classDesc("tc_class_cburst", "bytes that can be burst at 'infinite' speed {computed}"),
+
+		classBytesDesc:      classDesc("tc_class_bytes_total", "number of seen bytes"),
+		classPacketsDesc:    classDesc("tc_class_packets_total", "number of seen packets"),
+		classDropsDesc:      classDesc("tc_class_drops_total", "number of dropped packets"),
+		classOverlimitsDesc: classDesc("tc_class_overlimits_total", "number of enqueues over the limit"),
+		classRequeuesDesc:   classDesc("tc_class_requeues_total", "number of requeues"),
+		classLendedDesc:     classDesc("tc_class_lended_total", "lended tokens (htb)"),
+		classBorrowedDesc:   classDesc("tc_class_borrowed_total", "borrowed tokens (htb)"),
+		classBacklogDesc:    classDesc("tc_class_backlog", "backlog size"),
+		classQlenDesc:       classDesc("tc_class_qlen", "qlen size"),
+	}
+}
+
+func (c *tcCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.classPrioDesc
+	ch <- c.classRateDesc
+	ch <- c.classCeilDesc
+	ch <- c.classBurstDesc
+	ch <- c.classCburstDesc
+	ch <- qdiscR2qDesc
+	ch <- qdiscDirectPacketsStatDesc
+	ch <- qdiscDirectQlenDesc
+	ch <- c.classBytesDesc
+	ch <- c.classPacketsDesc
+	ch <- c.classDropsDesc
+	ch <- c.classOverlimitsDesc
+	ch <- c.classRequeuesDesc
+	ch <- c.classLendedDesc
+	ch <- c.classBorrowedDesc
+	ch <- c.classBacklogDesc
+	ch <- c.classQlenDesc
+	ch <- qdiscBytesDesc
+	ch <- qdiscPacketsDesc
+	ch <- qdiscDropsDesc
+	ch <- qdiscOverlimitsDesc
+	ch <- qdiscRequeuesDesc
+	ch <- qdiscBacklogDesc
+	ch <- qdiscQlenDesc
+	ch <- fqCodelMaxPacketDesc
+	ch <- fqCodelDropOverlimitDesc
+	ch <- fqCodelEcnMarkDesc
+	ch <- fqCodelNewFlowCountDesc
+	ch <- fqCodelNewFlowsLenDesc
+	ch <- fqCodelOldFlowsLenDesc
+	ch <- fqCodelMemoryUsedDesc
+	ch <- cakeTinSentBytesDesc
+	ch <- cakeTinSentPacketsDesc
+	ch <- cakeTinDropsDesc
+	ch <- cakeTinEcnMarksDesc
+	ch <- cakeTinSparseFlowsDesc
+	ch <- cakeTinBulkFlowsDesc
+	ch <- cakeTinUnresponsiveFlowsDesc
+	ch <- tbfTokensDesc
+	ch <- tbfPtokensDesc
+	ch <- sfqAllotDesc
+	ch <- redEarlyDesc
+	ch <- redPdropDesc
+	ch <- redOtherDesc
+	ch <- redMarkedDesc
+	ch <- pieProbDesc
+	ch <- pieDelayDesc
+	ch <- pieAvgDqRateDesc
+	ch <- piePacketsInDesc
+	ch <- pieDroppedDesc
+	ch <- pieOverlimitDesc
+	ch <- pieMaxqDesc
+	ch <- pieEcnMarkDesc
+}
+
+func (c *tcCollector) Collect(ch chan<- prometheus.Metric) {
+	nics, err := selectDevices()
+	if err != nil {
+		log.Printf("select devices: %v", err)
+		return
+	}
+	classes, err := collectMetricsClasses(nics)
+	if err != nil {
+		log.Printf("collect classes: %v", err)
+		return
+	}
+	qdiscs, err := collectMetricsQdiscs(nics)
+	if err != nil {
+		log.Printf("collect qdiscs: %v", err)
+		return
+	}
+
+	var classIDIndex map[uint32]cgroupInfo
+	if c.cgroupCorrelation {
+		classIDIndex, err = buildClassIDIndex(*cgroupRoot)
+		if err != nil {
+			log.Printf("build cgroup classid index: %v", err)
+		}
+	}
+
+	for _, class := range classes {
+		labels := []string{class.Kind, class.Handle, class.Parent, class.Device}
+		if c.cgroupCorrelation {
+			info := lookupCgroup(classIDIndex, class.Handle)
+			labels = append(labels, info.Path, info.ContainerID, info.Pod)
+		}
+		ch <- prometheus.MustNewConstMetric(c.classPrioDesc, prometheus.GaugeValue, float64(class.Prio), labels...)
+		ch <- prometheus.MustNewConstMetric(c.classRateDesc, prometheus.GaugeValue, float64(class.Rate), labels...)
+		ch <- prometheus.MustNewConstMetric(c.classCeilDesc, prometheus.GaugeValue, float64(class.Ceil), labels...)
+		ch <- prometheus.MustNewConstMetric(c.classBurstDesc, prometheus.GaugeValue, float64(class.Burst), labels...)
+		ch <- prometheus.MustNewConstMetric(c.classCburstDesc, prometheus.GaugeValue, float64(class.Cburst), labels...)
+		ch <- prometheus.MustNewConstMetric(c.classBytesDesc, prometheus.CounterValue, float64(class.Stats.Bytes), labels...)
+		ch <- prometheus.MustNewConstMetric(c.classPacketsDesc, prometheus.CounterValue, float64(class.Stats.Packets), labels...)
+		ch <- prometheus.MustNewConstMetric(c.classDropsDesc, prometheus.CounterValue, float64(class.Stats.Drops), labels...)
+		ch <- prometheus.MustNewConstMetric(c.classOverlimitsDesc, prometheus.CounterValue, float64(class.Stats.Overlimits), labels...)
+		ch <- prometheus.MustNewConstMetric(c.classRequeuesDesc, prometheus.CounterValue, float64(class.Stats.Requeues), labels...)
+		ch <- prometheus.MustNewConstMetric(c.classLendedDesc, prometheus.CounterValue, float64(class.Stats.Lended), labels...)
+		ch <- prometheus.MustNewConstMetric(c.classBorrowedDesc, prometheus.CounterValue, float64(class.Stats.Borrowed), labels...)
+		ch <- prometheus.MustNewConstMetric(c.classBacklogDesc, prometheus.GaugeValue, float64(class.Stats.Backlog), labels...)
+		ch <- prometheus.MustNewConstMetric(c.classQlenDesc, prometheus.GaugeValue, float64(class.Stats.Qlen), labels...)
+	}
+
+	for _, qdisc := range qdiscs {
+		labels := []string{qdisc.Kind, qdisc.Handle, qdisc.Parent, qdisc.Device}
+		ch <- prometheus.MustNewConstMetric(qdiscR2qDesc, prometheus.GaugeValue, float64(qdisc.Options.R2q), labels...)
+		ch <- prometheus.MustNewConstMetric(qdiscDirectPacketsStatDesc, prometheus.GaugeValue, float64(qdisc.Options.DirectPacketsStat), labels...)
+		ch <- prometheus.MustNewConstMetric(qdiscDirectQlenDesc, prometheus.GaugeValue, float64(qdisc.Options.DirectQlen), labels...)
+		ch <- prometheus.MustNewConstMetric(qdiscBytesDesc, prometheus.CounterValue, float64(qdisc.Bytes), labels...)
+		ch <- prometheus.MustNewConstMetric(qdiscPacketsDesc, prometheus.CounterValue, float64(qdisc.Packets), labels...)
+		ch <- prometheus.MustNewConstMetric(qdiscDropsDesc, prometheus.CounterValue, float64(qdisc.Drops), labels...)
+		ch <- prometheus.MustNewConstMetric(qdiscOverlimitsDesc, prometheus.CounterValue, float64(qdisc.Overlimits), labels...)
+		ch <- prometheus.MustNewConstMetric(qdiscRequeuesDesc, prometheus.CounterValue, float64(qdisc.Requeues), labels...)
+		ch <- prometheus.MustNewConstMetric(qdiscBacklogDesc, prometheus.GaugeValue, float64(qdisc.Backlog), labels...)
+		ch <- prometheus.MustNewConstMetric(qdiscQlenDesc, prometheus.GaugeValue, float64(qdisc.Qlen), labels...)
+		collectXStats(ch, labels, qdisc.XStats)
+	}
+}
+
+// collectXStats emits the per-kind extended statistics decoded onto a
+// qdisc, if any. At most one of xs's fields is set.
+func collectXStats(ch chan<- prometheus.Metric, labels []string, xs XStats) {
+	switch {
+	case xs.FqCodel != nil:
+		f := xs.FqCodel
+		ch <- prometheus.MustNewConstMetric(fqCodelMaxPacketDesc, prometheus.GaugeValue, float64(f.MaxPacket), labels...)
+		ch <- prometheus.MustNewConstMetric(fqCodelDropOverlimitDesc, prometheus.CounterValue, float64(f.DropOverlimit), labels...)
+		ch <- prometheus.MustNewConstMetric(fqCodelEcnMarkDesc, prometheus.CounterValue, float64(f.EcnMark), labels...)
+		ch <- prometheus.MustNewConstMetric(fqCodelNewFlowCountDesc, prometheus.CounterValue, float64(f.NewFlowCount), labels...)
+		ch <- prometheus.MustNewConstMetric(fqCodelNewFlowsLenDesc, prometheus.GaugeValue, float64(f.NewFlowsLen), labels...)
+		ch <- prometheus.MustNewConstMetric(fqCodelOldFlowsLenDesc, prometheus.GaugeValue, float64(f.OldFlowsLen), labels...)
+		ch <- prometheus.MustNewConstMetric(fqCodelMemoryUsedDesc, prometheus.GaugeValue, float64(f.MemoryUsed), labels...)
+	case xs.Cake != nil:
+		for i, tin := range xs.Cake.Tins {
+			tinLabels := append(append([]string{}, labels...), fmt.Sprintf("%d", i))
+			ch <- prometheus.MustNewConstMetric(cakeTinSentBytesDesc, prometheus.CounterValue, float64(tin.SentBytes), tinLabels...)
+			ch <- prometheus.MustNewConstMetric(cakeTinSentPacketsDesc, prometheus.CounterValue, float64(tin.SentPackets), tinLabels...)
+			ch <- prometheus.MustNewConstMetric(cakeTinDropsDesc, prometheus.CounterValue, float64(tin.Drops), tinLabels...)
+			ch <- prometheus.MustNewConstMetric(cakeTinEcnMarksDesc, prometheus.CounterValue, float64(tin.EcnMarks), tinLabels...)
+			ch <- prometheus.MustNewConstMetric(cakeTinSparseFlowsDesc, prometheus.GaugeValue, float64(tin.SparseFlows), tinLabels...)
+			ch <- prometheus.MustNewConstMetric(cakeTinBulkFlowsDesc, prometheus.GaugeValue, float64(tin.BulkFlows), tinLabels...)
+			ch <- prometheus.MustNewConstMetric(cakeTinUnresponsiveFlowsDesc, prometheus.GaugeValue, float64(tin.UnresponsiveFlows), tinLabels...)
+		}
+	case xs.Tbf != nil:
+		ch <- prometheus.MustNewConstMetric(tbfTokensDesc, prometheus.GaugeValue, float64(xs.Tbf.Tokens), labels...)
+		ch <- prometheus.MustNewConstMetric(tbfPtokensDesc, prometheus.GaugeValue, float64(xs.Tbf.Ptokens), labels...)
+	case xs.Sfq != nil:
+		ch <- prometheus.MustNewConstMetric(sfqAllotDesc, prometheus.GaugeValue, float64(xs.Sfq.Allot), labels...)
+	case xs.Red != nil:
+		ch <- prometheus.MustNewConstMetric(redEarlyDesc, prometheus.CounterValue, float64(xs.Red.Early), labels...)
+		ch <- prometheus.MustNewConstMetric(redPdropDesc, prometheus.CounterValue, float64(xs.Red.Pdrop), labels...)
+		ch <- prometheus.MustNewConstMetric(redOtherDesc, prometheus.CounterValue, float64(xs.Red.Other), labels...)
+		ch <- prometheus.MustNewConstMetric(redMarkedDesc, prometheus.CounterValue, float64(xs.Red.Marked), labels...)
+	case xs.Pie != nil:
+		p := xs.Pie
+		ch <- prometheus.MustNewConstMetric(pieProbDesc, prometheus.GaugeValue, float64(p.Prob), labels...)
+		ch <- prometheus.MustNewConstMetric(pieDelayDesc, prometheus.GaugeValue, float64(p.Delay), labels...)
+		ch <- prometheus.MustNewConstMetric(pieAvgDqRateDesc, prometheus.GaugeValue, float64(p.AvgDqRate), labels...)
+		ch <- prometheus.MustNewConstMetric(piePacketsInDesc, prometheus.CounterValue, float64(p.PacketsIn), labels...)
+		ch <- prometheus.MustNewConstMetric(pieDroppedDesc, prometheus.CounterValue, float64(p.Dropped), labels...)
+		ch <- prometheus.MustNewConstMetric(pieOverlimitDesc, prometheus.CounterValue, float64(p.Overlimit), labels...)
+		ch <- prometheus.MustNewConstMetric(pieMaxqDesc, prometheus.GaugeValue, float64(p.Maxq), labels...)
+		ch <- prometheus.MustNewConstMetric(pieEcnMarkDesc, prometheus.CounterValue, float64(p.EcnMark), labels...)
+	}
+}
+
+var (
+	deviceInclude = flag.String("collector.device-include", "", "Regexp of devices to include. Mutually exclusive with collector.device-exclude.")
+	deviceExclude = flag.String("collector.device-exclude", "", "Regexp of devices to exclude. Mutually exclusive with collector.device-include.")
+	deviceAuto    = flag.Bool("collector.device-auto", false, "Automatically select every device (except loopback) when no include/exclude regexp is given.")
+
+	cgroupCorrelation = flag.Bool("collector.cgroup-correlation", false, "Enrich tc_class_* series with cgroup/container_id/pod labels looked up from the net_cls classid of each class. Requires read access to the cgroup filesystem.")
+	cgroupRoot        = flag.String("collector.cgroup-root", "/sys/fs/cgroup", "Root of the cgroup filesystem to walk for --collector.cgroup-correlation.")
+
+	fixturesDir = flag.String("collector.fixtures", "", "Read class.json/qdisc.json from this directory instead of invoking tc or netlink (for testing).")
+)
+
+// selectDevices enumerates the host's interfaces on every call and filters
+// them against --collector.device-include / --collector.device-exclude, so
+// devices that come and go (veth pairs, hot-plugged NICs) don't require a
+// restart to pick up. In fixture mode it returns a single synthetic device
+// named after the fixtures directory instead.
+func selectDevices() ([]string, error) {
+	if *fixturesDir != "" {
+		return []string{filepath.Base(*fixturesDir)}, nil
+	}
+
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return nil, fmt.Errorf("list interfaces: %w", err)
+	}
+
+	var include, exclude *regexp.Regexp
+	if *deviceInclude != "" {
+		include, err = regexp.Compile(*deviceInclude)
+		if err != nil {
+			return nil, fmt.Errorf("collector.device-include: %w", err)
+		}
+	}
+	if *deviceExclude != "" {
+		exclude, err = regexp.Compile(*deviceExclude)
+		if err != nil {
+			return nil, fmt.Errorf("collector.device-exclude: %w", err)
+		}
+	}
+
+	var devices []string
+	for _, iface := range ifaces {
+		switch {
+		case include != nil:
+			if !include.MatchString(iface.Name) {
+				continue
+			}
+		case exclude != nil:
+			if exclude.MatchString(iface.Name) {
+				continue
+			}
+		case *deviceAuto:
+			if iface.Name == "lo" {
+				continue
+			}
+		default:
+			continue
+		}
+		devices = append(devices, iface.Name)
+	}
+	return devices, nil
+}
+
+// execFallback switches the collectors below from the native netlink backend
+// to shelling out to /usr/sbin/tc, for platforms/containers that can't grant
+// CAP_NET_ADMIN or otherwise can't open an rtnetlink socket.
+var execFallback = flag.Bool("exec-fallback", false, "collect via the tc binary instead of netlink (use on platforms without netlink permissions)")
+
 func collectMetricsClasses(nics []string) ([]Class, error) {
+	if *fixturesDir != "" {
+		return collectMetricsClassesFixtures(nics)
+	}
+	if *execFallback {
+		return collectMetricsClassesExec(nics)
+	}
+	return collectClassesNetlink(nics)
+}
+
+func collectMetricsQdiscs(nics []string) ([]Qdisc, error) {
+	if *fixturesDir != "" {
+		return collectMetricsQdiscsFixtures(nics)
+	}
+	if *execFallback {
+		return collectMetricsQdiscsExec(nics)
+	}
+	return collectQdiscsNetlink(nics)
+}
+
+func collectMetricsClassesExec(nics []string) ([]Class, error) {
 	var classes []Class
 
 	validNics := make([]string, 0, len(nics))
@@ -198,7 +583,7 @@ func collectMetricsClasses(nics []string) ([]Class, error) {
 	return classes, nil
 }
 
-func collectMetricsQdiscs(nics []string) ([]Qdisc, error) {
+func collectMetricsQdiscsExec(nics []string) ([]Qdisc, error) {
 	var qdiscs []Qdisc
 
 	validNics := make([]string, 0, len(nics))
@@ -224,6 +609,7 @@ func collectMetricsQdiscs(nics []string) ([]Qdisc, error) {
 			if qdiscs[i].Root {
 				qdiscs[i].Parent = "root"
 			}
+			qdiscs[i].XStats = decodeXStats(qdiscs[i].Kind, qdiscs[i].RawXStats)
 		}
 	}
 	return qdiscs, nil
@@ -232,105 +618,19 @@ func collectMetricsQdiscs(nics []string) ([]Qdisc, error) {
 func main() {
 	port := flag.Int("p", 9096, "Port to listen on")
 	flag.Parse()
-	if flag.NArg() < 1 {
-		log.Fatalf("Usage: %s -p <port> <interfaces...>", os.Args[0])
-	}
-	nics := flag.Args()
-
-	// Register params
-	paramsRegistry.MustRegister(prioGauge, rateGauge, ceilGauge, burstGauge, cburstGauge, r2qGauge, direct_packets_statGauge, direct_qlenGauge)
-
-	// Register metrics
-	statsRegistry.MustRegister(
-		cstatsBytesGauge, cstatsPacketsGauge, cstatsDropsGauge,
-		cstatsOverlimitsGauge, cstatsRequeuesGauge,
-		cstatsLendedGauge, cstatsBorrowedGauge,
-		qstatsBytesGauge, qstatsPacketsGauge, qstatsDropsGauge,
-		qstatsOverlimitsGauge, qstatsRequeuesGauge,
-		qstatsBacklogGauge, qstatsLenGauge,
-	)
-
-	http.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
-		cstatsBytesGauge.Reset()
-		cstatsPacketsGauge.Reset()
-		cstatsDropsGauge.Reset()
-		cstatsOverlimitsGauge.Reset()
-		cstatsRequeuesGauge.Reset()
-		cstatsLendedGauge.Reset()
-		cstatsBorrowedGauge.Reset()
-		qstatsBytesGauge.Reset()
-		qstatsPacketsGauge.Reset()
-		qstatsDropsGauge.Reset()
-		qstatsOverlimitsGauge.Reset()
-		qstatsRequeuesGauge.Reset()
-		qstatsBacklogGauge.Reset()
-		qstatsLenGauge.Reset()
-
-		classes, err := collectMetricsClasses(nics)
-		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
-		}
-		qdiscs, err := collectMetricsQdiscs(nics)
-		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
-		}
-		for _, class := range classes {
-			cstatsBytesGauge.WithLabelValues(class.Kind, class.Handle, class.Parent, class.Device).Set(float64(class.Stats.Bytes))
-			cstatsPacketsGauge.WithLabelValues(class.Kind, class.Handle, class.Parent, class.Device).Set(float64(class.Stats.Packets))
-			cstatsDropsGauge.WithLabelValues(class.Kind, class.Handle, class.Parent, class.Device).Set(float64(class.Stats.Drops))
-			cstatsOverlimitsGauge.WithLabelValues(class.Kind, class.Handle, class.Parent, class.Device).Set(float64(class.Stats.Overlimits))
-			cstatsRequeuesGauge.WithLabelValues(class.Kind, class.Handle, class.Parent, class.Device).Set(float64(class.Stats.Requeues))
-			cstatsLendedGauge.WithLabelValues(class.Kind, class.Handle, class.Parent, class.Device).Set(float64(class.Stats.Lended))
-			cstatsBorrowedGauge.WithLabelValues(class.Kind, class.Handle, class.Parent, class.Device).Set(float64(class.Stats.Borrowed))
-		}
-		for _, qdisc := range qdiscs {
-			qstatsBytesGauge.WithLabelValues(qdisc.Kind, qdisc.Handle, qdisc.Parent, qdisc.Device).Set(float64(qdisc.Bytes))
-			qstatsPacketsGauge.WithLabelValues(qdisc.Kind, qdisc.Handle, qdisc.Parent, qdisc.Device).Set(float64(qdisc.Packets))
-			qstatsDropsGauge.WithLabelValues(qdisc.Kind, qdisc.Handle, qdisc.Parent, qdisc.Device).Set(float64(qdisc.Drops))
-			qstatsOverlimitsGauge.WithLabelValues(qdisc.Kind, qdisc.Handle, qdisc.Parent, qdisc.Device).Set(float64(qdisc.Overlimits))
-			qstatsRequeuesGauge.WithLabelValues(qdisc.Kind, qdisc.Handle, qdisc.Parent, qdisc.Device).Set(float64(qdisc.Requeues))
-			qstatsBacklogGauge.WithLabelValues(qdisc.Kind, qdisc.Handle, qdisc.Parent, qdisc.Device).Set(float64(qdisc.Backlog))
-			qstatsLenGauge.WithLabelValues(qdisc.Kind, qdisc.Handle, qdisc.Parent, qdisc.Device).Set(float64(qdisc.Qlen))
-		}
-		promhttp.HandlerFor(statsRegistry, promhttp.HandlerOpts{}).ServeHTTP(w, r)
-	})
-
-	http.HandleFunc("/params", func(w http.ResponseWriter, r *http.Request) {
-		prioGauge.Reset()
-		rateGauge.Reset()
-		ceilGauge.Reset()
-		burstGauge.Reset()
-		cburstGauge.Reset()
-		r2qGauge.Reset()
-		direct_packets_statGauge.Reset()
-		direct_qlenGauge.Reset()
-
-		classes, err := collectMetricsClasses(nics)
-		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
-		}
-		qdiscs, err := collectMetricsQdiscs(nics)
-		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
-		}
-		for _, class := range classes {
-			prioGauge.WithLabelValues(class.Kind, class.Handle, class.Parent, class.Device).Set(float64(class.Prio))
-			rateGauge.WithLabelValues(class.Kind, class.Handle, class.Parent, class.Device).Set(float64(class.Rate))
-			ceilGauge.WithLabelValues(class.Kind, class.Handle, class.Parent, class.Device).Set(float64(class.Ceil))
-			burstGauge.WithLabelValues(class.Kind, class.Handle, class.Parent, class.Device).Set(float64(class.Burst))
-			cburstGauge.WithLabelValues(class.Kind, class.Handle, class.Parent, class.Device).Set(float64(class.Cburst))
+	if *fixturesDir == "" {
+		if *deviceInclude != "" && *deviceExclude != "" {
+			log.Fatal("collector.device-include and collector.device-exclude are mutually exclusive")
 		}
-		for _, qdisc := range qdiscs {
-			r2qGauge.WithLabelValues(qdisc.Kind, qdisc.Handle, qdisc.Parent, qdisc.Device).Set(float64(qdisc.Options.R2q))
-			direct_packets_statGauge.WithLabelValues(qdisc.Kind, qdisc.Handle, qdisc.Parent, qdisc.Device).Set(float64(qdisc.Options.DirectPacketsStat))
-			direct_qlenGauge.WithLabelValues(qdisc.Kind, qdisc.Handle, qdisc.Parent, qdisc.Device).Set(float64(qdisc.Options.DirectQlen))
+		if *deviceInclude == "" && *deviceExclude == "" && !*deviceAuto {
+			log.Fatal("one of collector.device-include, collector.device-exclude, or collector.device-auto is required")
 		}
-		promhttp.HandlerFor(paramsRegistry, promhttp.HandlerOpts{}).ServeHTTP(w, r)
-	})
+	}
+
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(newTCCollector())
+
+	http.Handle("/metrics", promhttp.HandlerFor(registry, promhttp.HandlerOpts{}))
 
 	log.Printf("Listening on :%d", *port)
 	log.Fatal(http.ListenAndServe(fmt.Sprintf(":%d", *port), nil))